@@ -137,17 +137,35 @@ func fullString(ip net.IP) string {
 		string(dst[28:])
 }
 
+// hostKeyword returns "host" for an IPv4 address and "ip6 host" for an IPv6 address, since
+// tcpdump requires the latter to match the expanded 8-group hex form fullString produces.
+func hostKeyword(ip net.IP) string {
+	if ip.To4() != nil {
+		return "host"
+	}
+	return "ip6 host"
+}
+
 func bpfFilter(prefix string, addr net.Addr) (string, error) {
 	switch t := addr.(type) {
 	case *net.IPAddr:
-		return fmt.Sprintf("(%s host %s)", prefix, fullString(addr.(*net.IPAddr).IP)), nil
+		ipAddr := addr.(*net.IPAddr)
+		return fmt.Sprintf("(%s %s %s)", prefix, hostKeyword(ipAddr.IP), fullString(ipAddr.IP)), nil
 	case *net.TCPAddr:
 		tcpAddr := addr.(*net.TCPAddr)
 
 		if tcpAddr.IP == nil {
 			return fmt.Sprintf("(%s port %d)", prefix, tcpAddr.Port), nil
 		} else {
-			return fmt.Sprintf("(%s host %s && %s port %d)", prefix, fullString(tcpAddr.IP), prefix, tcpAddr.Port), nil
+			return fmt.Sprintf("(%s %s %s && %s port %d)", prefix, hostKeyword(tcpAddr.IP), fullString(tcpAddr.IP), prefix, tcpAddr.Port), nil
+		}
+	case *net.UDPAddr:
+		udpAddr := addr.(*net.UDPAddr)
+
+		if udpAddr.IP == nil {
+			return fmt.Sprintf("(%s port %d)", prefix, udpAddr.Port), nil
+		} else {
+			return fmt.Sprintf("(%s %s %s && %s port %d)", prefix, hostKeyword(udpAddr.IP), fullString(udpAddr.IP), prefix, udpAddr.Port), nil
 		}
 	default:
 		return "", fmt.Errorf("type %T not support", t)
@@ -162,4 +180,4 @@ func SrcBPFFilter(addr net.Addr) (string, error) {
 // DstBPFFilter returns a destination BPF filter by the giver address
 func DstBPFFilter(addr net.Addr) (string, error) {
 	return bpfFilter("dst", addr)
-}
\ No newline at end of file
+}
@@ -0,0 +1,76 @@
+package pcap
+
+import "sync"
+
+// Buffer tiers for the adaptive framer's pool. A record is served from the smallest tier that
+// fits it so idle, low-traffic connections do not pin a 64 KiB buffer each.
+const (
+	bufferTierSmall  = 4 * 1024
+	bufferTierMedium = 16 * 1024
+	bufferTierLarge  = 64 * 1024
+)
+
+var (
+	bufferPoolSmall  = sync.Pool{New: func() interface{} { return make([]byte, bufferTierSmall) }}
+	bufferPoolMedium = sync.Pool{New: func() interface{} { return make([]byte, bufferTierMedium) }}
+	bufferPoolLarge  = sync.Pool{New: func() interface{} { return make([]byte, bufferTierLarge) }}
+)
+
+// getBuffer returns a buffer of at least size bytes from the smallest fitting tier, or a
+// one-off allocation if size exceeds the largest tier.
+func getBuffer(size int) []byte {
+	switch {
+	case size <= bufferTierSmall:
+		return bufferPoolSmall.Get().([]byte)[:size]
+	case size <= bufferTierMedium:
+		return bufferPoolMedium.Get().([]byte)[:size]
+	case size <= bufferTierLarge:
+		return bufferPoolLarge.Get().([]byte)[:size]
+	default:
+		return make([]byte, size)
+	}
+}
+
+// putBuffer returns b to the pool matching its capacity. Buffers that came from a one-off
+// allocation (above the largest tier) are simply dropped.
+func putBuffer(b []byte) {
+	switch cap(b) {
+	case bufferTierSmall:
+		bufferPoolSmall.Put(b[:bufferTierSmall])
+	case bufferTierMedium:
+		bufferPoolMedium.Put(b[:bufferTierMedium])
+	case bufferTierLarge:
+		bufferPoolLarge.Put(b[:bufferTierLarge])
+	}
+}
+
+// recordSizeEWMA tracks an exponentially weighted moving average of recent record lengths. Once a
+// record's length prefix has been read, the framer draws its buffer from a tier that fits the
+// larger of that length and this average.
+type recordSizeEWMA struct {
+	mutex sync.Mutex
+	value float64
+}
+
+const recordSizeEWMAAlpha = 0.2
+
+func (e *recordSizeEWMA) update(sample int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.value == 0 {
+		e.value = float64(sample)
+		return
+	}
+	e.value = recordSizeEWMAAlpha*float64(sample) + (1-recordSizeEWMAAlpha)*e.value
+}
+
+func (e *recordSizeEWMA) estimate() int {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.value == 0 {
+		return bufferTierSmall
+	}
+	return int(e.value)
+}
@@ -0,0 +1,151 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/zhxie/ikago/internal/crypto"
+	"io"
+	"net"
+)
+
+const recordLengthPrefixSize = 4
+
+// maxRecordSize bounds how large a single record's declared length may be before readRecord
+// refuses it, so a peer cannot make us allocate an arbitrarily large buffer off an untrusted
+// 4-byte length prefix.
+const maxRecordSize = 16 * 1024 * 1024
+
+// framer turns the raw byte stream of a net.Conn into discrete, decrypted application records.
+// TCPConn holds one and asks it for the next record as Read drains the previous one.
+type framer interface {
+	// readRecord returns the next decrypted record, plus a release func the caller must invoke
+	// once it has fully consumed the record (so pooled buffers can be reused).
+	readRecord(conn net.Conn, crypt crypto.Crypt) (record []byte, release func(), err error)
+	// writeRecord encrypts b and writes it to conn in this framer's wire format.
+	writeRecord(conn net.Conn, crypt crypto.Crypt, b []byte) error
+}
+
+// adaptiveFramer is the default framer: every record is prefixed on the wire with its own 4-byte
+// big-endian length, so framing no longer depends on heuristically re-stitching a sticky TCP
+// stream. Buffers are drawn from the tiered pool, sized from an EWMA of recent record lengths.
+type adaptiveFramer struct {
+	ewma recordSizeEWMA
+}
+
+func newAdaptiveFramer() *adaptiveFramer {
+	return &adaptiveFramer{}
+}
+
+func (f *adaptiveFramer) readRecord(conn net.Conn, crypt crypto.Crypt) ([]byte, func(), error) {
+	var lenBuf [recordLengthPrefixSize]byte
+	if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+		return nil, nil, err
+	}
+	length := int(binary.BigEndian.Uint32(lenBuf[:]))
+	if length > maxRecordSize {
+		return nil, nil, fmt.Errorf("record of %d bytes exceeds maxRecordSize of %d bytes", length, maxRecordSize)
+	}
+
+	tierHint := length
+	if est := f.ewma.estimate(); est > tierHint {
+		tierHint = est
+	}
+
+	buf := getBuffer(tierHint)[:length]
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		putBuffer(buf)
+		return nil, nil, err
+	}
+
+	f.ewma.update(length)
+
+	dp, err := crypt.Decrypt(buf)
+	if err != nil {
+		putBuffer(buf)
+		return nil, nil, fmt.Errorf("decrypt: %w", err)
+	}
+
+	return dp, func() { putBuffer(buf) }, nil
+}
+
+// writeRecord encrypts b and writes it to conn with the 4-byte length prefix readRecord expects.
+func (f *adaptiveFramer) writeRecord(conn net.Conn, crypt crypto.Crypt, b []byte) error {
+	contents, err := crypt.Encrypt(b)
+	if err != nil {
+		return fmt.Errorf("encrypt: %w", err)
+	}
+
+	var lenBuf [recordLengthPrefixSize]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(contents)))
+
+	if _, err := conn.Write(append(lenBuf[:], contents...)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// legacyFramer reproduces the original behaviour: a fixed 65535-byte buffer read straight from
+// conn, decrypted as one chunk, then re-stuck into discrete packets by a Desticker. It exists so
+// peers that predate the length-prefixed wire format can still be dialed or accepted via the
+// legacyFramer parameter of DialTCP and ListenTCP.
+type legacyFramer struct {
+	buffer  []byte
+	destick *Desticker
+	stash   [][]byte
+	stashId int
+}
+
+func newLegacyFramer() *legacyFramer {
+	f := &legacyFramer{
+		buffer:  make([]byte, 65535),
+		destick: NewDesticker(),
+		stash:   make([][]byte, 0),
+	}
+	f.destick.SetDeadline(keepSticky)
+
+	return f
+}
+
+func (f *legacyFramer) readRecord(conn net.Conn, crypt crypto.Crypt) ([]byte, func(), error) {
+	for f.stash == nil || len(f.stash) <= f.stashId {
+		n, err := conn.Read(f.buffer)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		dp, err := crypt.Decrypt(f.buffer[:n])
+		if err != nil {
+			return nil, nil, fmt.Errorf("decrypt: %w", err)
+		}
+
+		packets, err := f.destick.Append(dp)
+		if err != nil {
+			return nil, nil, fmt.Errorf("destick: %w", err)
+		}
+
+		if len(packets) == 0 {
+			return []byte{}, func() {}, nil
+		}
+
+		f.stash = packets
+		f.stashId = 0
+	}
+
+	record := f.stash[f.stashId]
+	f.stashId++
+
+	return record, func() {}, nil
+}
+
+// writeRecord reproduces the original wire format: the encrypted bytes, with no length prefix,
+// relying on the peer's Desticker to re-stitch sticky or split TCP reads.
+func (f *legacyFramer) writeRecord(conn net.Conn, crypt crypto.Crypt, b []byte) error {
+	contents, err := crypt.Encrypt(b)
+	if err != nil {
+		return fmt.Errorf("encrypt: %w", err)
+	}
+
+	_, err = conn.Write(contents)
+	return err
+}
@@ -0,0 +1,799 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/zhxie/ikago/internal/crypto"
+	"github.com/zhxie/ikago/internal/log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	kcpCmdPush byte = 81
+	kcpCmdAck  byte = 82
+	kcpCmdWAsk byte = 83
+	kcpCmdWIns byte = 84
+
+	kcpHeaderSize = 24
+	kcpMTU        = 1400
+
+	kcpRTOMin = 100 * time.Millisecond
+	kcpRTOMax = 60000 * time.Millisecond
+
+	kcpDatagramBuffer = 2048
+)
+
+// KCPConfig describes the tunable ARQ knobs of a KCP session, mirroring the
+// nodelay/interval/resend/nc quadruplet plus window and MTU sizing.
+type KCPConfig struct {
+	// NoDelay halves the minimum RTO. ACKs are sent on every flush whether or not it is set.
+	NoDelay bool
+	// Interval is the period of the internal update/flush loop.
+	Interval time.Duration
+	// Resend is the number of larger-sn duplicate ACKs that trigger a fast resend, 0 to disable.
+	Resend int
+	// NoCongestionControl sends at the full send/remote window. When it is false the window is
+	// also capped by cwnd, which starts at one segment and is never grown.
+	NoCongestionControl bool
+	// SendWindow is the size of the send window in segments.
+	SendWindow int
+	// RecvWindow is the size of the receive window in segments.
+	RecvWindow int
+	// MTU is the maximum size of a single UDP datagram carrying segments.
+	MTU int
+}
+
+// DefaultKCPConfig returns the KCPConfig used when none is supplied.
+func DefaultKCPConfig() *KCPConfig {
+	return &KCPConfig{
+		NoDelay:             true,
+		Interval:            20 * time.Millisecond,
+		Resend:              2,
+		NoCongestionControl: false,
+		SendWindow:          128,
+		RecvWindow:          128,
+		MTU:                 kcpMTU,
+	}
+}
+
+// kcpSegment is a single ARQ segment, conv/cmd/frg/wnd/ts/sn/una/len followed by data.
+type kcpSegment struct {
+	conv uint32
+	cmd  byte
+	frg  uint8
+	wnd  uint16
+	ts   uint32
+	sn   uint32
+	una  uint32
+	data []byte
+
+	resendTs uint32
+	rto      uint32
+	fastAck  int
+	xmit     int
+}
+
+func (seg *kcpSegment) encode(b []byte) []byte {
+	binary.LittleEndian.PutUint32(b[0:], seg.conv)
+	b[4] = seg.cmd
+	b[5] = seg.frg
+	binary.LittleEndian.PutUint16(b[6:], seg.wnd)
+	binary.LittleEndian.PutUint32(b[8:], seg.ts)
+	binary.LittleEndian.PutUint32(b[12:], seg.sn)
+	binary.LittleEndian.PutUint32(b[16:], seg.una)
+	binary.LittleEndian.PutUint32(b[20:], uint32(len(seg.data)))
+	n := copy(b[kcpHeaderSize:], seg.data)
+	return b[:kcpHeaderSize+n]
+}
+
+func decodeKCPSegment(b []byte) (*kcpSegment, []byte, error) {
+	if len(b) < kcpHeaderSize {
+		return nil, nil, fmt.Errorf("truncated segment header")
+	}
+
+	seg := &kcpSegment{
+		conv: binary.LittleEndian.Uint32(b[0:]),
+		cmd:  b[4],
+		frg:  b[5],
+		wnd:  binary.LittleEndian.Uint16(b[6:]),
+		ts:   binary.LittleEndian.Uint32(b[8:]),
+		sn:   binary.LittleEndian.Uint32(b[12:]),
+		una:  binary.LittleEndian.Uint32(b[16:]),
+	}
+	length := binary.LittleEndian.Uint32(b[20:])
+	b = b[kcpHeaderSize:]
+	if uint32(len(b)) < length {
+		return nil, nil, fmt.Errorf("truncated segment payload")
+	}
+
+	seg.data = make([]byte, length)
+	copy(seg.data, b[:length])
+
+	return seg, b[length:], nil
+}
+
+// kcpSession implements the ARQ state machine shared by KCPConn and KCPListener's accepted peers.
+type kcpSession struct {
+	conv uint32
+	cfg  *KCPConfig
+
+	mutex sync.Mutex
+
+	sendQueue []*kcpSegment
+	sendBuf   []*kcpSegment
+	recvBuf   []*kcpSegment
+	recvQueue []*kcpSegment
+	acklist   []ackEntry
+
+	sndUna uint32
+	sndNxt uint32
+	rcvNxt uint32
+
+	rmtWnd   uint32
+	cwnd     uint32
+	ssthresh uint32
+
+	rxSrtt   uint32
+	rxRttval uint32
+	rxRto    uint32
+
+	current uint32
+	start   time.Time
+
+	recvEvent chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	output func(b []byte) error
+}
+
+type ackEntry struct {
+	sn uint32
+	ts uint32
+}
+
+func newKCPSession(conv uint32, cfg *KCPConfig, output func(b []byte) error) *kcpSession {
+	if cfg == nil {
+		cfg = DefaultKCPConfig()
+	}
+
+	s := &kcpSession{
+		conv:      conv,
+		cfg:       cfg,
+		rmtWnd:    uint32(cfg.RecvWindow),
+		cwnd:      1,
+		ssthresh:  uint32(cfg.SendWindow),
+		rxRto:     uint32(kcpRTOMin.Milliseconds()),
+		start:     time.Now(),
+		recvEvent: make(chan struct{}, 1),
+		closed:    make(chan struct{}),
+		output:    output,
+	}
+
+	return s
+}
+
+func (s *kcpSession) now() uint32 {
+	return uint32(time.Now().Sub(s.start).Milliseconds())
+}
+
+// send appends b as one or more fragments to the send queue.
+func (s *kcpSession) send(b []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	mss := s.cfg.MTU - kcpHeaderSize
+	count := (len(b) + mss - 1) / mss
+	if count == 0 {
+		count = 1
+	}
+
+	for i := 0; i < count; i++ {
+		size := mss
+		if i == count-1 {
+			size = len(b) - i*mss
+		}
+
+		seg := &kcpSegment{
+			conv: s.conv,
+			cmd:  kcpCmdPush,
+			frg:  uint8(count - i - 1),
+			data: append([]byte(nil), b[i*mss:i*mss+size]...),
+		}
+
+		s.sendQueue = append(s.sendQueue, seg)
+	}
+}
+
+// input feeds one decoded incoming datagram (possibly several segments) into the ARQ state.
+func (s *kcpSession) input(data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for len(data) > 0 {
+		seg, rest, err := decodeKCPSegment(data)
+		if err != nil {
+			return err
+		}
+		data = rest
+
+		s.rmtWnd = uint32(seg.wnd)
+		s.updateUna(seg.una)
+
+		switch seg.cmd {
+		case kcpCmdAck:
+			s.ackReceived(seg.sn, seg.ts)
+		case kcpCmdWAsk:
+			// Peer asks for our window, answered on the next flush via WINS.
+		case kcpCmdWIns:
+			// Peer reports its window, already recorded above.
+		case kcpCmdPush:
+			if seg.sn >= s.rcvNxt+uint32(s.cfg.RecvWindow) {
+				continue
+			}
+			s.acklist = append(s.acklist, ackEntry{sn: seg.sn, ts: seg.ts})
+			if seg.sn >= s.rcvNxt {
+				s.insertRecvBuf(seg)
+			}
+		}
+	}
+
+	s.moveRecvBufToQueue()
+
+	select {
+	case s.recvEvent <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (s *kcpSession) updateUna(una uint32) {
+	i := 0
+	for ; i < len(s.sendBuf); i++ {
+		if s.sendBuf[i].sn >= una {
+			break
+		}
+	}
+	s.sendBuf = s.sendBuf[i:]
+	if s.sndUna < una {
+		s.sndUna = una
+	}
+}
+
+func (s *kcpSession) ackReceived(sn, ts uint32) {
+	for i, seg := range s.sendBuf {
+		if seg.sn == sn {
+			rtt := int32(s.now() - ts)
+			if rtt >= 0 {
+				s.updateRTO(rtt)
+			}
+			s.sendBuf = append(s.sendBuf[:i], s.sendBuf[i+1:]...)
+			return
+		}
+		if seg.sn < sn {
+			seg.fastAck++
+		}
+	}
+}
+
+func (s *kcpSession) updateRTO(rtt int32) {
+	if s.rxSrtt == 0 {
+		s.rxSrtt = uint32(rtt)
+		s.rxRttval = uint32(rtt) / 2
+	} else {
+		delta := int32(s.rxSrtt) - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		s.rxRttval = (3*s.rxRttval + uint32(delta)) / 4
+		s.rxSrtt = (7*s.rxSrtt + uint32(rtt)) / 8
+	}
+
+	rto := s.rxSrtt + max32(uint32(s.cfg.Interval.Milliseconds()), 4*s.rxRttval)
+	if s.cfg.NoDelay {
+		s.rxRto = clampU32(rto, uint32(kcpRTOMin.Milliseconds())/2, uint32(kcpRTOMax.Milliseconds()))
+	} else {
+		s.rxRto = clampU32(rto, uint32(kcpRTOMin.Milliseconds()), uint32(kcpRTOMax.Milliseconds()))
+	}
+}
+
+func (s *kcpSession) insertRecvBuf(seg *kcpSegment) {
+	for _, existing := range s.recvBuf {
+		if existing.sn == seg.sn {
+			return
+		}
+	}
+
+	i := len(s.recvBuf)
+	for i > 0 && s.recvBuf[i-1].sn > seg.sn {
+		i--
+	}
+	s.recvBuf = append(s.recvBuf, nil)
+	copy(s.recvBuf[i+1:], s.recvBuf[i:])
+	s.recvBuf[i] = seg
+}
+
+func (s *kcpSession) moveRecvBufToQueue() {
+	i := 0
+	for ; i < len(s.recvBuf); i++ {
+		seg := s.recvBuf[i]
+		if seg.sn != s.rcvNxt {
+			break
+		}
+		s.recvQueue = append(s.recvQueue, seg)
+		s.rcvNxt++
+	}
+	s.recvBuf = s.recvBuf[i:]
+}
+
+// errKCPRecvEmpty signals that recv has nothing ready yet, as opposed to a real error.
+var errKCPRecvEmpty = errors.New("kcp: no data ready")
+
+// recv pops one reassembled message (possibly fragmented across several segments) from the
+// queue into b. If the reassembled message does not fit in b, recv leaves the queue untouched
+// and returns an error instead of silently truncating the message, so the caller can retry with
+// a larger buffer.
+func (s *kcpSession) recv(b []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.recvQueue) == 0 {
+		return 0, errKCPRecvEmpty
+	}
+
+	total := 0
+	count := 0
+	complete := false
+	for _, seg := range s.recvQueue {
+		total += len(seg.data)
+		count++
+		if seg.frg == 0 {
+			complete = true
+			break
+		}
+	}
+
+	if !complete {
+		// The final fragment of this message hasn't arrived yet, mirroring ikcp_peeksize's
+		// nrcv_que < seg->frg + 1 guard: a run of trailing frg != 0 segments is not yet a
+		// complete message, so don't hand the caller a truncated read.
+		return 0, errKCPRecvEmpty
+	}
+
+	if total > len(b) {
+		return 0, fmt.Errorf("kcp: reassembled message of %d bytes exceeds read buffer of %d bytes", total, len(b))
+	}
+
+	n := 0
+	for i := 0; i < count; i++ {
+		n += copy(b[n:], s.recvQueue[0].data)
+		s.recvQueue = s.recvQueue[1:]
+	}
+
+	return n, nil
+}
+
+// flush moves ready segments from the send queue into the send buffer, emits ACKs and resends
+// anything whose RTO has elapsed or that has seen `Resend` duplicate later ACKs.
+func (s *kcpSession) flush() {
+	s.mutex.Lock()
+	current := s.now()
+	s.current = current
+
+	wnd := s.sendWindow()
+	for len(s.sendQueue) > 0 && s.sndNxt < s.sndUna+wnd {
+		seg := s.sendQueue[0]
+		s.sendQueue = s.sendQueue[1:]
+		seg.sn = s.sndNxt
+		seg.rto = s.rxRto
+		seg.resendTs = current
+		s.sndNxt++
+		s.sendBuf = append(s.sendBuf, seg)
+	}
+
+	acks := s.acklist
+	s.acklist = nil
+	una := s.rcvNxt
+	rcvWnd := uint32(s.cfg.RecvWindow)
+	resend := s.cfg.Resend
+
+	// Encode every outgoing segment while still holding the lock: input()/ackReceived() mutate
+	// these same *kcpSegment pointers (fastAck, sendBuf membership) from the reader goroutine, so
+	// reading or writing their fields after unlocking would race. raws holds the wire bytes only;
+	// nothing below touches a shared segment again.
+	var raws [][]byte
+
+	for _, a := range acks {
+		seg := &kcpSegment{conv: s.conv, cmd: kcpCmdAck, sn: a.sn, ts: a.ts, wnd: uint16(rcvWnd), una: una}
+		raw := make([]byte, kcpHeaderSize+len(seg.data))
+		seg.encode(raw)
+		raws = append(raws, raw)
+	}
+
+	for _, seg := range s.sendBuf {
+		needSend := seg.xmit == 0
+		if !needSend && current >= seg.resendTs {
+			needSend = true
+		}
+		if !needSend && resend > 0 && seg.fastAck >= resend {
+			needSend = true
+		}
+
+		if needSend {
+			seg.xmit++
+			seg.resendTs = current + seg.rto
+			seg.una = una
+			seg.wnd = uint16(rcvWnd)
+
+			raw := make([]byte, kcpHeaderSize+len(seg.data))
+			seg.encode(raw)
+			raws = append(raws, raw)
+		}
+	}
+
+	s.mutex.Unlock()
+
+	buf := make([]byte, 0, s.cfg.MTU)
+	for _, raw := range raws {
+		if len(buf)+len(raw) > s.cfg.MTU {
+			_ = s.output(buf)
+			buf = buf[:0]
+		}
+		buf = append(buf, raw...)
+	}
+
+	if len(buf) > 0 {
+		_ = s.output(buf)
+	}
+}
+
+func (s *kcpSession) sendWindow() uint32 {
+	wnd := uint32(s.cfg.SendWindow)
+	if wnd > s.rmtWnd {
+		wnd = s.rmtWnd
+	}
+	if !s.cfg.NoCongestionControl && s.cwnd < wnd {
+		wnd = s.cwnd
+	}
+	if wnd == 0 {
+		wnd = 1
+	}
+	return wnd
+}
+
+// updateLoop periodically calls flush until the session is closed.
+func (s *kcpSession) updateLoop() {
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+func (s *kcpSession) close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+}
+
+func max32(a, b uint32) uint32 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func clampU32(v, lo, hi uint32) uint32 {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+// KCPConn is a reliable, ordered net.Conn layered over an unreliable UDP socket using the KCP ARQ.
+type KCPConn struct {
+	conn    *net.UDPConn
+	peer    *net.UDPAddr
+	crypt   crypto.Crypt
+	session *kcpSession
+	recvBuf []byte
+
+	// connected is true when conn came from net.DialUDP (DialKCP's own socket, one peer), and
+	// false when conn is a listener's shared net.ListenUDP socket demultiplexing many peers by
+	// conv. A connected UDPConn must be written to with Write, not WriteToUDP, which refuses to
+	// operate on a pre-connected socket.
+	connected bool
+
+	closed chan struct{}
+}
+
+func newKCPConn(conn *net.UDPConn, peer *net.UDPAddr, conv uint32, cfg *KCPConfig, crypt crypto.Crypt) *KCPConn {
+	c := &KCPConn{
+		conn:      conn,
+		peer:      peer,
+		crypt:     crypt,
+		connected: conn.RemoteAddr() != nil,
+		closed:    make(chan struct{}),
+	}
+
+	c.session = newKCPSession(conv, cfg, func(b []byte) error {
+		return c.sendDatagram(b)
+	})
+
+	go c.session.updateLoop()
+
+	return c
+}
+
+func (c *KCPConn) sendDatagram(b []byte) error {
+	cp, err := c.crypt.Encrypt(b)
+	if err != nil {
+		return fmt.Errorf("encrypt: %w", err)
+	}
+
+	if c.connected {
+		_, err = c.conn.Write(cp)
+	} else {
+		_, err = c.conn.WriteToUDP(cp, c.peer)
+	}
+	return err
+}
+
+// DialKCP dials a KCP session to dstAddr over the given capture device, acting like DialUDP for pcap
+// networks but exposing a reliable, ordered net.Conn backed by the KCP ARQ.
+func DialKCP(dev *Device, srcPort uint16, dstAddr *net.UDPAddr, crypt crypto.Crypt, cfg *KCPConfig) (*KCPConn, error) {
+	if cfg == nil {
+		cfg = DefaultKCPConfig()
+	}
+
+	srcAddr := &net.UDPAddr{
+		IP:   dev.IPAddr().IP,
+		Port: int(srcPort),
+	}
+
+	log.Infof("Connect to server %s\n", dstAddr.String())
+
+	conn, err := net.DialUDP("udp4", srcAddr, dstAddr)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    err,
+		}
+	}
+
+	conv := newKCPConv()
+
+	kcpConn := newKCPConn(conn, dstAddr, conv, cfg, crypt)
+
+	go kcpConn.readLoop()
+
+	log.Infof("Connected to server %s (conv %d)\n", dstAddr.String(), conv)
+
+	return kcpConn, nil
+}
+
+func (c *KCPConn) readLoop() {
+	buffer := make([]byte, kcpDatagramBuffer)
+
+	for {
+		n, err := c.conn.Read(buffer)
+		if err != nil {
+			return
+		}
+
+		dp, err := c.crypt.Decrypt(buffer[:n])
+		if err != nil {
+			log.Errorln(fmt.Errorf("decrypt: %w", err))
+			continue
+		}
+
+		if err := c.session.input(dp); err != nil {
+			log.Errorln(fmt.Errorf("input: %w", err))
+		}
+	}
+}
+
+func (c *KCPConn) Read(b []byte) (int, error) {
+	for {
+		n, err := c.session.recv(b)
+		if err == nil {
+			return n, nil
+		}
+		if !errors.Is(err, errKCPRecvEmpty) {
+			return 0, &net.OpError{Op: "read", Net: "pcap", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: err}
+		}
+
+		select {
+		case <-c.session.recvEvent:
+		case <-c.closed:
+			return 0, &net.OpError{Op: "read", Net: "pcap", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: fmt.Errorf("use of closed connection")}
+		}
+	}
+}
+
+func (c *KCPConn) Write(b []byte) (int, error) {
+	c.session.send(b)
+	return len(b), nil
+}
+
+func (c *KCPConn) Close() error {
+	c.session.close()
+	close(c.closed)
+	return c.conn.Close()
+}
+
+func (c *KCPConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *KCPConn) RemoteAddr() net.Addr {
+	return c.peer
+}
+
+func (c *KCPConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *KCPConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *KCPConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// KCPListener demultiplexes incoming KCP datagrams by conversation ID and hands each new peer a
+// KCPConn through Accept, mirroring TCPListener's net.Listener surface.
+type KCPListener struct {
+	conn  *net.UDPConn
+	crypt crypto.Crypt
+	cfg   *KCPConfig
+
+	mutex    sync.Mutex
+	sessions map[uint32]*KCPConn
+	accept   chan *KCPConn
+	closed   chan struct{}
+}
+
+// ListenKCP acts like ListenUDP for pcap networks, accepting KCP sessions demultiplexed by conv.
+func ListenKCP(dev *Device, srcPort uint16, crypt crypto.Crypt, cfg *KCPConfig) (*KCPListener, error) {
+	if cfg == nil {
+		cfg = DefaultKCPConfig()
+	}
+
+	srcAddr := &net.UDPAddr{
+		IP:   dev.IPAddr().IP,
+		Port: int(srcPort),
+	}
+
+	conn, err := net.ListenUDP("udp4", srcAddr)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "listen",
+			Net:    "pcap",
+			Source: srcAddr,
+			Err:    err,
+		}
+	}
+
+	l := &KCPListener{
+		conn:     conn,
+		crypt:    crypt,
+		cfg:      cfg,
+		sessions: make(map[uint32]*KCPConn),
+		accept:   make(chan *KCPConn),
+		closed:   make(chan struct{}),
+	}
+
+	go l.readLoop()
+
+	return l, nil
+}
+
+func (l *KCPListener) readLoop() {
+	buffer := make([]byte, kcpDatagramBuffer)
+
+	for {
+		n, peer, err := l.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		dp, err := l.crypt.Decrypt(buffer[:n])
+		if err != nil {
+			log.Errorln(fmt.Errorf("decrypt: %w", err))
+			continue
+		}
+		if len(dp) < 4 {
+			continue
+		}
+		conv := binary.LittleEndian.Uint32(dp)
+
+		l.mutex.Lock()
+		conn, ok := l.sessions[conv]
+		if !ok {
+			conn = l.newSession(conv, peer)
+			l.sessions[conv] = conn
+		}
+		l.mutex.Unlock()
+
+		if err := conn.session.input(dp); err != nil {
+			log.Errorln(fmt.Errorf("input: %w", err))
+			continue
+		}
+
+		if !ok {
+			select {
+			case l.accept <- conn:
+			case <-l.closed:
+				return
+			}
+		}
+	}
+}
+
+func (l *KCPListener) newSession(conv uint32, peer *net.UDPAddr) *KCPConn {
+	conn := &KCPConn{
+		conn:   l.conn,
+		peer:   peer,
+		crypt:  l.crypt,
+		closed: make(chan struct{}),
+	}
+	conn.session = newKCPSession(conv, l.cfg, func(b []byte) error {
+		return conn.sendDatagram(b)
+	})
+	go conn.session.updateLoop()
+
+	return conn
+}
+
+func (l *KCPListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "accept", Net: "pcap", Addr: l.Addr(), Err: fmt.Errorf("listener closed")}
+	}
+}
+
+func (l *KCPListener) Close() error {
+	l.mutex.Lock()
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	for _, conn := range l.sessions {
+		conn.session.close()
+	}
+	l.mutex.Unlock()
+
+	return l.conn.Close()
+}
+
+func (l *KCPListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+var kcpConvCounter uint32 = 1
+
+func newKCPConv() uint32 {
+	return atomic.AddUint32(&kcpConvCounter, 1)
+}
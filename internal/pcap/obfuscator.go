@@ -0,0 +1,42 @@
+package pcap
+
+import (
+	"fmt"
+	"net"
+)
+
+// Obfuscator wraps a freshly dialed or accepted net.Conn in a handshake that disguises the
+// connection's framing before crypto.Crypt ever sees the stream. A nil Obfuscator leaves the
+// connection untouched.
+type Obfuscator interface {
+	// ClientHandshake runs the client side of the obfuscation handshake over conn and returns
+	// a net.Conn whose Read/Write operate on the obfuscated stream.
+	ClientHandshake(conn net.Conn) (net.Conn, error)
+	// ServerHandshake runs the server side of the obfuscation handshake over conn and returns
+	// a net.Conn whose Read/Write operate on the obfuscated stream.
+	ServerHandshake(conn net.Conn) (net.Conn, error)
+}
+
+// obfuscators holds the transports selectable by name from config, e.g. "obfs4".
+var obfuscators = map[string]func() (Obfuscator, error){}
+
+// RegisterObfuscator makes an Obfuscator available under name for ObfuscatorByName, so config can
+// select a transport by string instead of constructing one directly.
+func RegisterObfuscator(name string, factory func() (Obfuscator, error)) {
+	obfuscators[name] = factory
+}
+
+// ObfuscatorByName looks up an Obfuscator registered with RegisterObfuscator. An empty name
+// returns a nil Obfuscator, leaving the connection unobfuscated.
+func ObfuscatorByName(name string) (Obfuscator, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	factory, ok := obfuscators[name]
+	if !ok {
+		return nil, fmt.Errorf("obfuscator %s not found", name)
+	}
+
+	return factory()
+}
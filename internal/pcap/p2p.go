@@ -0,0 +1,116 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/zhxie/ikago/internal/crypto"
+	"github.com/zhxie/ikago/internal/log"
+	"github.com/zhxie/ikago/internal/stun"
+	"net"
+	"time"
+)
+
+const (
+	holePunchWindow   = 10 * time.Second
+	holePunchInterval = 200 * time.Millisecond
+)
+
+// DialP2P rendezvous-assists a direct, NAT-punched KCP session with peerID: both ends learn their
+// reflexive address via STUN, exchange it through rendezvous, and exchange UDP keepalives until a
+// bidirectional path opens, at which point the punched flow is handed to the KCP transport.
+//
+// rendezvous doubles as the first of two STUN servers used to register the candidate address. If
+// altStunServer is non-nil, it is probed alongside rendezvous via stun.ClassifyNATType to tell a
+// symmetric NAT apart from a cone NAT before punching is attempted; Discover's single-probe
+// heuristic cannot make that distinction on its own. If altStunServer is nil, DialP2P falls back
+// to Discover's heuristic, which never reports a symmetric NAT, so DialP2P does not refuse early.
+func DialP2P(dev *Device, srcPort uint16, peerID string, rendezvous *net.UDPAddr, altStunServer *net.UDPAddr, crypt crypto.Crypt) (net.Conn, error) {
+	srcAddr := &net.UDPAddr{
+		IP:   dev.IPAddr().IP,
+		Port: int(srcPort),
+	}
+
+	conn, err := net.ListenUDP("udp4", srcAddr)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Err:    err,
+		}
+	}
+
+	reflexive, natType, err := stun.Discover(rendezvous.String())
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("stun discover: %w", err)
+	}
+
+	log.Infof("Discovered reflexive address %s (NAT type %s)\n", reflexive.String(), natType.String())
+
+	if altStunServer != nil {
+		classified, err := stun.ClassifyNATType(rendezvous.String(), altStunServer.String())
+		if err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("classify nat type: %w", err)
+		}
+		natType = classified
+		log.Infof("Classified NAT type %s using %s and %s\n", natType.String(), rendezvous.String(), altStunServer.String())
+	}
+
+	if natType == stun.NATSymmetric {
+		_ = conn.Close()
+		return nil, fmt.Errorf("cannot punch through a symmetric NAT without a relay")
+	}
+
+	if err := stun.RegisterCandidate(conn, rendezvous, peerID, reflexive); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("register candidate: %w", err)
+	}
+
+	peer, err := stun.FetchCandidate(conn, rendezvous, peerID, time.Now().Add(holePunchWindow))
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("fetch peer candidate: %w", err)
+	}
+
+	if err := punch(conn, peer); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("hole punch: %w", err)
+	}
+
+	log.Infof("Punched a direct path to peer %s at %s\n", peerID, peer.String())
+
+	kcpConn := newKCPConn(conn, peer, newKCPConv(), DefaultKCPConfig(), crypt)
+	go kcpConn.readLoop()
+
+	return kcpConn, nil
+}
+
+// punch exchanges keepalive probes with peer until one of them is answered or holePunchWindow
+// elapses, opening the NAT mapping in both directions simultaneously.
+func punch(conn *net.UDPConn, peer *net.UDPAddr) error {
+	deadline := time.Now().Add(holePunchWindow)
+	probe := []byte("ikago-punch")
+
+	if err := conn.SetReadDeadline(time.Now().Add(holePunchInterval)); err != nil {
+		return err
+	}
+
+	buf := make([]byte, len(probe))
+	for time.Now().Before(deadline) {
+		if _, err := conn.WriteToUDP(probe, peer); err != nil {
+			return fmt.Errorf("send probe: %w", err)
+		}
+
+		if err := conn.SetReadDeadline(time.Now().Add(holePunchInterval)); err != nil {
+			return err
+		}
+
+		n, from, err := conn.ReadFromUDP(buf)
+		if err == nil && n == len(probe) && from.IP.Equal(peer.IP) && from.Port == peer.Port {
+			return conn.SetReadDeadline(time.Time{})
+		}
+	}
+
+	return fmt.Errorf("no probe from %s within %s", peer.String(), holePunchWindow)
+}
@@ -0,0 +1,190 @@
+package pcap
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// BBR-inspired constants: bbrBwWindow/bbrRTTWindow bound the max/min filters for BtlBw/RTprop,
+// and bbrPacingGain/bbrCwndGain scale them into a pacing rate and an in-flight cap.
+const (
+	bbrBwWindow   = 10 // samples, one per Write call
+	bbrRTTWindow  = 10 * time.Second
+	bbrPacingGain = 1.25
+	bbrCwndGain   = 2.0
+)
+
+// Stats reports a TCPConn's pacing controller state, for operators to graph throughput and RTT
+// estimates without instrumenting the transport itself.
+type Stats struct {
+	// BtlBw is the estimated bottleneck bandwidth in bytes/sec: the max delivery rate sampled
+	// over the last bbrBwWindow Write calls. The window is a sample count, not bounded by RTT.
+	BtlBw float64
+	// RTprop is the estimated round-trip propagation time: the min RTT sampled over the last
+	// bbrRTTWindow.
+	RTprop time.Duration
+	// InFlightCap is the target congestion window, bbrCwndGain*BtlBw*RTprop: the BDP-based limit
+	// the pacer aims to keep outstanding bytes under. It is not presently enforced — Write only
+	// paces the send rate to PacingRate and never blocks or queues based on this cap — so treat it
+	// as an estimate for observability, not a guarantee of bounded in-flight bytes.
+	InFlightCap int
+	// PacingRate is the rate, in bytes/sec, Write currently paces output at.
+	PacingRate float64
+}
+
+type rttSample struct {
+	at  time.Time
+	val time.Duration
+}
+
+type bwSample struct {
+	at  time.Time
+	val float64
+}
+
+// rttSampler abstracts how a pacer learns the connection's current RTT and unacknowledged segment
+// count: on Linux this reads TCP_INFO, elsewhere it falls back to timing the gap between writes.
+type rttSampler interface {
+	sample() (rtt time.Duration, inFlight int, ok bool)
+}
+
+// fallbackRTTSampler is used wherever TCP_INFO is unavailable (non-Linux, or a conn wrapped by
+// an Obfuscator, which Linux's newRTTSampler also falls back to). It estimates RTT from the gap
+// between consecutive onWrite samples rather than kernel instrumentation, which is far noisier
+// but keeps the pacer functional everywhere.
+type fallbackRTTSampler struct {
+	mutex  sync.Mutex
+	lastAt time.Time
+}
+
+func (s *fallbackRTTSampler) sample() (time.Duration, int, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	if s.lastAt.IsZero() {
+		s.lastAt = now
+		return 0, 0, false
+	}
+
+	rtt := now.Sub(s.lastAt)
+	s.lastAt = now
+
+	return rtt, 0, true
+}
+
+// bbrPacer estimates BtlBw/RTprop from RTT and delivery-rate samples and paces Write calls to
+// bbrPacingGain*BtlBw. It reports bbrCwndGain*BtlBw*RTprop as an in-flight cap in Stats but does
+// not enforce it.
+type bbrPacer struct {
+	mutex sync.Mutex
+
+	rttSamples []rttSample
+	bwSamples  []bwSample
+
+	delivered   int
+	deliveredAt time.Time
+	sampler     rttSampler
+}
+
+func newBBRPacer(conn net.Conn) *bbrPacer {
+	return &bbrPacer{
+		deliveredAt: time.Now(),
+		sampler:     newRTTSampler(conn),
+	}
+}
+
+// onWrite records n bytes as delivered and folds in a fresh RTT/in-flight sample, pruning
+// samples outside their respective windows.
+func (p *bbrPacer) onWrite(n int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+
+	elapsed := now.Sub(p.deliveredAt).Seconds()
+	p.delivered += n
+	if elapsed > 0 {
+		rate := float64(p.delivered) / elapsed
+		p.bwSamples = append(p.bwSamples, bwSample{at: now, val: rate})
+	}
+	p.deliveredAt = now
+	p.delivered = 0
+
+	if rtt, _, ok := p.sampler.sample(); ok {
+		p.rttSamples = append(p.rttSamples, rttSample{at: now, val: rtt})
+	}
+
+	p.prune(now)
+}
+
+func (p *bbrPacer) prune(now time.Time) {
+	i := 0
+	for ; i < len(p.rttSamples); i++ {
+		if now.Sub(p.rttSamples[i].at) <= bbrRTTWindow {
+			break
+		}
+	}
+	p.rttSamples = p.rttSamples[i:]
+
+	if len(p.bwSamples) > bbrBwWindow {
+		p.bwSamples = p.bwSamples[len(p.bwSamples)-bbrBwWindow:]
+	}
+}
+
+func (p *bbrPacer) btlBw() float64 {
+	max := 0.0
+	for _, s := range p.bwSamples {
+		if s.val > max {
+			max = s.val
+		}
+	}
+	return max
+}
+
+func (p *bbrPacer) rtProp() time.Duration {
+	if len(p.rttSamples) == 0 {
+		return 0
+	}
+	min := p.rttSamples[0].val
+	for _, s := range p.rttSamples[1:] {
+		if s.val < min {
+			min = s.val
+		}
+	}
+	return min
+}
+
+// pacingDelay returns how long Write should sleep before sending n more bytes to stay at
+// bbrPacingGain*BtlBw.
+func (p *bbrPacer) pacingDelay(n int) time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	bw := p.btlBw()
+	if bw <= 0 {
+		return 0
+	}
+
+	return time.Duration(float64(n) / (bbrPacingGain * bw) * float64(time.Second))
+}
+
+func (p *bbrPacer) stats() Stats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	bw := p.btlBw()
+	rtProp := p.rtProp()
+
+	inFlightCap := int(bbrCwndGain * bw * rtProp.Seconds())
+
+	pacingRate := bw * bbrPacingGain
+
+	return Stats{
+		BtlBw:       bw,
+		RTprop:      rtProp,
+		InFlightCap: inFlightCap,
+		PacingRate:  pacingRate,
+	}
+}
@@ -0,0 +1,42 @@
+//go:build linux
+
+package pcap
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// linuxRTTSampler reads TCP_INFO off the underlying *net.TCPConn's file descriptor, giving an
+// accurate kernel-measured RTT and unacknowledged segment count instead of timing writes
+// ourselves.
+type linuxRTTSampler struct {
+	tcpConn *net.TCPConn
+}
+
+func newRTTSampler(conn net.Conn) rttSampler {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		return &linuxRTTSampler{tcpConn: tcpConn}
+	}
+	return &fallbackRTTSampler{}
+}
+
+func (s *linuxRTTSampler) sample() (time.Duration, int, bool) {
+	raw, err := s.tcpConn.SyscallConn()
+	if err != nil {
+		return 0, 0, false
+	}
+
+	var info *unix.TCPInfo
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		info, sockErr = unix.GetsockoptTCPInfo(int(fd), unix.SOL_TCP, unix.TCP_INFO)
+	})
+	if err != nil || sockErr != nil || info == nil {
+		return 0, 0, false
+	}
+
+	return time.Duration(info.Rtt) * time.Microsecond, int(info.Unacked), true
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package pcap
+
+import (
+	"net"
+)
+
+func newRTTSampler(conn net.Conn) rttSampler {
+	return &fallbackRTTSampler{}
+}
@@ -2,6 +2,7 @@ package pcap
 
 import (
 	"fmt"
+	"github.com/zhxie/ikago/internal/addr"
 	"github.com/zhxie/ikago/internal/crypto"
 	"github.com/zhxie/ikago/internal/log"
 	"net"
@@ -10,120 +11,209 @@ import (
 
 const keepSticky = 30 * time.Second
 
+// happyEyeballsDelay is the head start RFC 8305 gives the IPv6 dial attempt before racing IPv4.
+const happyEyeballsDelay = 250 * time.Millisecond
+
 type TCPConn struct {
-	conn    *net.TCPConn
-	crypt   crypto.Crypt
-	buffer  []byte
-	destick *Desticker
-	stash   [][]byte
-	stashId int
+	conn   net.Conn
+	crypt  crypto.Crypt
+	framer framer
+	pacer  *bbrPacer
+
+	pending        []byte
+	pendingRelease func()
 }
 
-func newTCPConn() *TCPConn {
-	conn := &TCPConn{
-		buffer:  make([]byte, 65535),
-		destick: NewDesticker(),
-		stash:   make([][]byte, 0),
+// newTCPConn builds a TCPConn around the adaptive framer and BBR pacer unless legacyFramer asks
+// for the original fixed-buffer Desticker path.
+func newTCPConn(conn net.Conn, legacyFramer bool) *TCPConn {
+	c := &TCPConn{
+		conn:  conn,
+		pacer: newBBRPacer(conn),
+	}
+
+	if legacyFramer {
+		c.framer = newLegacyFramer()
+	} else {
+		c.framer = newAdaptiveFramer()
 	}
-	conn.destick.SetDeadline(keepSticky)
 
-	return conn
+	return c
 }
 
-// DialTCP acts like DialTCP for pcap networks.
-func DialTCP(dev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt) (*TCPConn, error) {
-	srcAddr := &net.TCPAddr{
-		IP:   dev.IPAddr().IP,
-		Port: int(srcPort),
-	}
+// Stats reports the connection's current BBR pacing estimates.
+func (c *TCPConn) Stats() Stats {
+	return c.pacer.stats()
+}
 
+// DialTCP acts like DialTCP for pcap networks. dstAddr may carry both an IPv4 and an IPv6
+// candidate, in which case the IPv6 dial gets a happyEyeballsDelay head start over IPv4 per
+// RFC 8305 and whichever connects first wins; the loser is closed. obfuscator may be nil, in
+// which case crypt sees the raw TCP stream as before. legacyFramer selects the original
+// fixed-buffer Desticker path instead of the length-prefixed adaptive framer, for dialing peers
+// that predate it.
+func DialTCP(dev *Device, srcPort uint16, dstAddr *addr.MultiIPAddr, dstPort uint16, crypt crypto.Crypt, obfuscator Obfuscator, legacyFramer bool) (*TCPConn, error) {
 	log.Infof("Connect to server %s\n", dstAddr.String())
 
 	t := time.Now()
 
-	conn, err := net.DialTCP("tcp4", srcAddr, dstAddr)
+	conn, winner, err := dialHappyEyeballs(dev, srcPort, dstAddr, dstPort)
 	if err != nil {
-		return nil, &net.OpError{
-			Op:     "dial",
-			Net:    "pcap",
-			Source: srcAddr,
-			Addr:   dstAddr,
-			Err:    err,
+		return nil, err
+	}
+
+	var wrapped net.Conn = conn
+	if obfuscator != nil {
+		wrapped, err = obfuscator.ClientHandshake(conn)
+		if err != nil {
+			_ = conn.Close()
+			return nil, &net.OpError{
+				Op:   "dial",
+				Net:  "pcap",
+				Addr: winner,
+				Err:  fmt.Errorf("obfuscate: %w", err),
+			}
 		}
 	}
 
 	duration := time.Now().Sub(t)
 
-	log.Infof("Connected to server %s in %.3f ms (RTT)\n", dstAddr.String(), float64(duration.Microseconds())/1000)
+	log.Infof("Connected to server %s in %.3f ms (RTT)\n", winner.String(), float64(duration.Microseconds())/1000)
 
-	tcpConn := newTCPConn()
-	tcpConn.conn = conn
+	tcpConn := newTCPConn(wrapped, legacyFramer)
 	tcpConn.crypt = crypt
 
 	return tcpConn, nil
 }
 
-func (c *TCPConn) Read(b []byte) (n int, err error) {
-	// If stashed packets exist, read from stash, otherwise, read from conn
-	if c.stash == nil || len(c.stash) <= c.stashId {
-		n, err = c.conn.Read(c.buffer)
-		if err != nil {
-			return 0, err
-		}
+// tcpDialResult is the outcome of one racing dial attempt in dialHappyEyeballs.
+type tcpDialResult struct {
+	conn *net.TCPConn
+	addr *net.TCPAddr
+	err  error
+}
 
-		dp, err := c.crypt.Decrypt(c.buffer[:n])
-		if err != nil {
-			return 0, &net.OpError{
-				Op:     "read",
-				Net:    "pcap",
-				Source: c.LocalAddr(),
-				Addr:   c.RemoteAddr(),
-				Err:    fmt.Errorf("decrypt: %w", err),
+// dialHappyEyeballs races tcp4 and tcp6 dials to dstAddr:dstPort, giving tcp6 a head start, and
+// returns the first successful connection along with the address it connected to.
+func dialHappyEyeballs(dev *Device, srcPort uint16, dstAddr *addr.MultiIPAddr, dstPort uint16) (*net.TCPConn, *net.TCPAddr, error) {
+	v4 := dstAddr.IPv4()
+	v6 := dstAddr.IPv6()
+
+	if v4 == nil && v6 == nil {
+		return nil, nil, fmt.Errorf("no usable address in %s", dstAddr.String())
+	}
+
+	results := make(chan tcpDialResult, 2)
+	attempt := func(network string, ip net.IP, delay time.Duration) {
+		if ip == nil {
+			return
+		}
+		go func() {
+			if delay > 0 {
+				time.Sleep(delay)
 			}
+
+			srcAddr := &net.TCPAddr{IP: dev.IPAddr().IP, Port: int(srcPort)}
+			remote := &net.TCPAddr{IP: ip, Port: int(dstPort)}
+
+			conn, err := net.DialTCP(network, srcAddr, remote)
+			results <- tcpDialResult{conn: conn, addr: remote, err: err}
+		}()
+	}
+
+	attempt("tcp6", v6, 0)
+	attempt("tcp4", v4, happyEyeballsDelay)
+
+	attempts := 0
+	if v4 != nil {
+		attempts++
+	}
+	if v6 != nil {
+		attempts++
+	}
+
+	var lastErr error
+	for i := 0; i < attempts; i++ {
+		r := <-results
+		if r.err == nil {
+			go drainLoser(results, attempts-i-1)
+			return r.conn, r.addr, nil
 		}
+		lastErr = r.err
+	}
+
+	return nil, nil, &net.OpError{
+		Op:  "dial",
+		Net: "pcap",
+		Err: fmt.Errorf("dial %s: %w", dstAddr.String(), lastErr),
+	}
+}
 
-		// Destick
-		packets, err := c.destick.Append(dp)
+// drainLoser closes any connections that win the race after the first, so their sockets don't leak.
+func drainLoser(results chan tcpDialResult, remaining int) {
+	for i := 0; i < remaining; i++ {
+		r := <-results
+		if r.conn != nil {
+			_ = r.conn.Close()
+		}
+	}
+}
+
+func (c *TCPConn) Read(b []byte) (n int, err error) {
+	// Fetch the next record once the previous one has been fully consumed
+	if len(c.pending) == 0 {
+		if c.pendingRelease != nil {
+			c.pendingRelease()
+			c.pendingRelease = nil
+		}
+
+		record, release, err := c.framer.readRecord(c.conn, c.crypt)
 		if err != nil {
+			if _, ok := err.(*net.OpError); ok {
+				return 0, err
+			}
 			return 0, &net.OpError{
 				Op:     "read",
 				Net:    "pcap",
 				Source: c.LocalAddr(),
 				Addr:   c.RemoteAddr(),
-				Err:    fmt.Errorf("destick: %w", err),
+				Err:    err,
 			}
 		}
 
-		if len(packets) == 0 {
+		if len(record) == 0 {
+			release()
 			return 0, nil
 		}
 
-		c.stash = packets
-		c.stashId = 0
+		c.pending = record
+		c.pendingRelease = release
 	}
 
-	// Read stashed packet
-	copy(b, c.stash[c.stashId])
+	n = copy(b, c.pending)
+	c.pending = c.pending[n:]
 
-	c.stashId++
-
-	return len(c.stash[c.stashId-1]), nil
+	return n, nil
 }
 
 func (c *TCPConn) Write(b []byte) (n int, err error) {
-	// Encrypt
-	contents, err := c.crypt.Encrypt(b)
-	if err != nil {
+	if d := c.pacer.pacingDelay(len(b)); d > 0 {
+		time.Sleep(d)
+	}
+
+	if err := c.framer.writeRecord(c.conn, c.crypt, b); err != nil {
 		return 0, &net.OpError{
 			Op:     "write",
 			Net:    "pcap",
 			Source: c.LocalAddr(),
 			Addr:   c.RemoteAddr(),
-			Err:    fmt.Errorf("encrypt: %w", err),
+			Err:    err,
 		}
 	}
 
-	return c.conn.Write(contents)
+	c.pacer.onWrite(len(b))
+
+	return len(b), nil
 }
 
 func (c *TCPConn) Close() error {
@@ -151,50 +241,110 @@ func (c *TCPConn) SetWriteDeadline(t time.Time) error {
 }
 
 type TCPListener struct {
-	listener *net.TCPListener
-	crypt    crypto.Crypt
+	listener4    *net.TCPListener
+	listener6    *net.TCPListener
+	crypt        crypto.Crypt
+	obfuscator   Obfuscator
+	legacyFramer bool
+
+	accept chan tcpAcceptResult
+}
+
+type tcpAcceptResult struct {
+	conn net.Conn
+	err  error
 }
 
-// ListenTCP acts like ListenTCP for pcap networks.
-func ListenTCP(dev *Device, srcPort uint16, crypt crypto.Crypt) (*TCPListener, error) {
-	srcAddr := &net.TCPAddr{
-		IP:   dev.IPAddr().IP,
-		Port: int(srcPort),
+// ListenTCP acts like ListenTCP for pcap networks. When dev exposes both an IPv4 and an IPv6
+// address, ListenTCP binds both families and multiplexes Accept across them; otherwise it binds
+// whichever family dev has. obfuscator may be nil, in which case crypt sees the raw TCP stream
+// as before. legacyFramer selects the original fixed-buffer Desticker path instead of the
+// length-prefixed adaptive framer, for accepting peers that predate it.
+func ListenTCP(dev *Device, srcPort uint16, crypt crypto.Crypt, obfuscator Obfuscator, legacyFramer bool) (*TCPListener, error) {
+	l := &TCPListener{
+		crypt:        crypt,
+		obfuscator:   obfuscator,
+		legacyFramer: legacyFramer,
+		accept:       make(chan tcpAcceptResult),
 	}
 
-	listener, err := net.ListenTCP("tcp4", srcAddr)
-	if err != nil {
-		return nil, &net.OpError{
-			Op:     "listen",
-			Net:    "pcap",
-			Source: srcAddr,
-			Err:    err,
+	ips := dev.IPAddrs()
+
+	if v4 := ips.IPv4(); v4 != nil {
+		listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: v4, Port: int(srcPort)})
+		if err != nil {
+			return nil, &net.OpError{Op: "listen", Net: "pcap", Err: err}
 		}
+		l.listener4 = listener
+		go l.acceptLoop(listener)
 	}
 
-	return &TCPListener{
-		listener: listener,
-		crypt:    crypt,
-	}, nil
-}
+	if v6 := ips.IPv6(); v6 != nil {
+		listener, err := net.ListenTCP("tcp6", &net.TCPAddr{IP: v6, Port: int(srcPort)})
+		if err != nil {
+			if l.listener4 != nil {
+				_ = l.listener4.Close()
+			}
+			return nil, &net.OpError{Op: "listen", Net: "pcap", Err: err}
+		}
+		l.listener6 = listener
+		go l.acceptLoop(listener)
+	}
 
-func (l *TCPListener) Accept() (net.Conn, error) {
-	conn, err := l.listener.AcceptTCP()
-	if err != nil {
-		return nil, err
+	if l.listener4 == nil && l.listener6 == nil {
+		return nil, &net.OpError{Op: "listen", Net: "pcap", Err: fmt.Errorf("no usable address on device")}
 	}
 
-	tcpConn := newTCPConn()
-	tcpConn.conn = conn
-	tcpConn.crypt = l.crypt
+	return l, nil
+}
 
-	return tcpConn, nil
+func (l *TCPListener) acceptLoop(listener *net.TCPListener) {
+	for {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			l.accept <- tcpAcceptResult{err: err}
+			return
+		}
+
+		var wrapped net.Conn = conn
+		if l.obfuscator != nil {
+			wrapped, err = l.obfuscator.ServerHandshake(conn)
+			if err != nil {
+				_ = conn.Close()
+				continue
+			}
+		}
+
+		tcpConn := newTCPConn(wrapped, l.legacyFramer)
+		tcpConn.crypt = l.crypt
+
+		l.accept <- tcpAcceptResult{conn: tcpConn}
+	}
+}
+
+func (l *TCPListener) Accept() (net.Conn, error) {
+	r := <-l.accept
+	return r.conn, r.err
 }
 
 func (l *TCPListener) Close() error {
-	return l.listener.Close()
+	var err error
+	if l.listener4 != nil {
+		if e := l.listener4.Close(); e != nil {
+			err = e
+		}
+	}
+	if l.listener6 != nil {
+		if e := l.listener6.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
 }
 
 func (l *TCPListener) Addr() net.Addr {
-	return l.listener.Addr()
+	if l.listener4 != nil {
+		return l.listener4.Addr()
+	}
+	return l.listener6.Addr()
 }
@@ -0,0 +1,103 @@
+package stun
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+const rendezvousTimeout = 5 * time.Second
+
+// rendezvousRequest is the JSON-over-UDP message exchanged with the rendezvous server: a peer
+// either registers its own candidate or fetches one registered under the same peerID by someone
+// else.
+type rendezvousRequest struct {
+	PeerID string `json:"peer_id"`
+	Addr   string `json:"addr,omitempty"`
+}
+
+type rendezvousResponse struct {
+	Addr  string `json:"addr,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// RegisterCandidate tells the rendezvous server that candidate is reachable at the given
+// reflexive address for peerID, so a peer fetching that peerID later learns where to punch to.
+func RegisterCandidate(conn *net.UDPConn, rendezvous *net.UDPAddr, peerID string, candidate *net.UDPAddr) error {
+	req := rendezvousRequest{PeerID: peerID, Addr: candidate.String()}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("marshal rendezvous request: %w", err)
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(rendezvousTimeout)); err != nil {
+		return err
+	}
+
+	if _, err := conn.WriteToUDP(b, rendezvous); err != nil {
+		return fmt.Errorf("write rendezvous request: %w", err)
+	}
+
+	buf := make([]byte, 512)
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		return fmt.Errorf("read rendezvous response: %w", err)
+	}
+
+	var resp rendezvousResponse
+	if err := json.Unmarshal(buf[:n], &resp); err != nil {
+		return fmt.Errorf("unmarshal rendezvous response: %w", err)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("rendezvous server: %s", resp.Error)
+	}
+
+	return nil
+}
+
+// FetchCandidate polls the rendezvous server for the candidate address peerID has registered,
+// retrying until deadline elapses.
+func FetchCandidate(conn *net.UDPConn, rendezvous *net.UDPAddr, peerID string, deadline time.Time) (*net.UDPAddr, error) {
+	req := rendezvousRequest{PeerID: peerID}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("marshal rendezvous request: %w", err)
+	}
+
+	for time.Now().Before(deadline) {
+		if err := conn.SetDeadline(time.Now().Add(rendezvousTimeout)); err != nil {
+			return nil, err
+		}
+
+		if _, err := conn.WriteToUDP(b, rendezvous); err != nil {
+			return nil, fmt.Errorf("write rendezvous request: %w", err)
+		}
+
+		buf := make([]byte, 512)
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			continue
+		}
+
+		var resp rendezvousResponse
+		if err := json.Unmarshal(buf[:n], &resp); err != nil {
+			continue
+		}
+		if resp.Addr == "" {
+			time.Sleep(200 * time.Millisecond)
+			continue
+		}
+
+		peerAddr, err := net.ResolveUDPAddr("udp4", resp.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("resolve peer candidate: %w", err)
+		}
+
+		return peerAddr, nil
+	}
+
+	return nil, fmt.Errorf("peer %s did not register within the deadline", peerID)
+}
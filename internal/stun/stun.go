@@ -0,0 +1,253 @@
+// Package stun implements the small slice of RFC 5389 STUN needed for ikago peers behind NAT to
+// learn their reflexive (server-observed) address ahead of a rendezvous-assisted hole punch.
+package stun
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	magicCookie uint32 = 0x2112A442
+
+	msgTypeBindingRequest  uint16 = 0x0001
+	msgTypeBindingResponse uint16 = 0x0101
+
+	attrXorMappedAddress uint16 = 0x0020
+
+	familyIPv4 byte = 0x01
+	familyIPv6 byte = 0x02
+
+	requestTimeout = 2 * time.Second
+)
+
+// NATType classifies how a NAT maps outbound flows, which determines whether two peers behind
+// NAT can hole-punch a direct path to each other.
+type NATType int
+
+const (
+	// NATUnknown means classification did not complete.
+	NATUnknown NATType = iota
+	// NATFullCone maps a given internal endpoint to the same external endpoint for any peer.
+	NATFullCone
+	// NATRestrictedCone maps to the same external endpoint, but only accepts inbound traffic
+	// from an IP the internal host has previously sent to.
+	NATRestrictedCone
+	// NATPortRestrictedCone is like NATRestrictedCone but also restricts by port.
+	NATPortRestrictedCone
+	// NATSymmetric maps a given internal endpoint to a different external endpoint per
+	// destination, which makes hole punching unreliable.
+	NATSymmetric
+)
+
+func (t NATType) String() string {
+	switch t {
+	case NATFullCone:
+		return "full cone"
+	case NATRestrictedCone:
+		return "restricted cone"
+	case NATPortRestrictedCone:
+		return "port restricted cone"
+	case NATSymmetric:
+		return "symmetric"
+	default:
+		return "unknown"
+	}
+}
+
+// transactionID is the random 96-bit transaction ID that ties a Binding Response to its Request.
+type transactionID [12]byte
+
+func newTransactionID() (transactionID, error) {
+	var id transactionID
+	if _, err := rand.Read(id[:]); err != nil {
+		return id, fmt.Errorf("generate transaction id: %w", err)
+	}
+	return id, nil
+}
+
+// encodeBindingRequest builds a 20-byte STUN Binding Request header with no attributes.
+func encodeBindingRequest(id transactionID) []byte {
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint16(b[0:], msgTypeBindingRequest)
+	binary.BigEndian.PutUint16(b[2:], 0)
+	binary.BigEndian.PutUint32(b[4:], magicCookie)
+	copy(b[8:], id[:])
+	return b
+}
+
+// xorMappedAddress decodes the XOR-MAPPED-ADDRESS attribute, XOR-ing the port with the top 16
+// bits of the magic cookie and the address with the cookie followed by the transaction ID.
+func xorMappedAddress(value []byte, id transactionID) (*net.UDPAddr, error) {
+	if len(value) < 4 {
+		return nil, fmt.Errorf("truncated xor-mapped-address")
+	}
+
+	family := value[1]
+	xport := binary.BigEndian.Uint16(value[2:4])
+	port := xport ^ uint16(magicCookie>>16)
+
+	var cookieAndID [16]byte
+	binary.BigEndian.PutUint32(cookieAndID[0:], magicCookie)
+	copy(cookieAndID[4:], id[:])
+
+	switch family {
+	case familyIPv4:
+		if len(value) < 8 {
+			return nil, fmt.Errorf("truncated ipv4 xor-mapped-address")
+		}
+		ip := make(net.IP, 4)
+		for i := 0; i < 4; i++ {
+			ip[i] = value[4+i] ^ cookieAndID[i]
+		}
+		return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+	case familyIPv6:
+		if len(value) < 20 {
+			return nil, fmt.Errorf("truncated ipv6 xor-mapped-address")
+		}
+		ip := make(net.IP, 16)
+		for i := 0; i < 16; i++ {
+			ip[i] = value[4+i] ^ cookieAndID[i]
+		}
+		return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+	default:
+		return nil, fmt.Errorf("unknown address family %d", family)
+	}
+}
+
+// parseBindingResponse reads the message header and walks its TLV attributes looking for
+// XOR-MAPPED-ADDRESS, returning the reflexive address it encodes.
+func parseBindingResponse(b []byte, id transactionID) (*net.UDPAddr, error) {
+	if len(b) < 20 {
+		return nil, fmt.Errorf("truncated message header")
+	}
+	if binary.BigEndian.Uint16(b[0:]) != msgTypeBindingResponse {
+		return nil, fmt.Errorf("unexpected message type 0x%04x", binary.BigEndian.Uint16(b[0:]))
+	}
+	if binary.BigEndian.Uint32(b[4:]) != magicCookie {
+		return nil, fmt.Errorf("bad magic cookie")
+	}
+
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	body := b[20:]
+	if len(body) < length {
+		return nil, fmt.Errorf("truncated message body")
+	}
+	body = body[:length]
+
+	for len(body) >= 4 {
+		attrType := binary.BigEndian.Uint16(body[0:])
+		attrLen := int(binary.BigEndian.Uint16(body[2:]))
+		if len(body) < 4+attrLen {
+			return nil, fmt.Errorf("truncated attribute")
+		}
+		value := body[4 : 4+attrLen]
+
+		if attrType == attrXorMappedAddress {
+			return xorMappedAddress(value, id)
+		}
+
+		// Attributes are padded to a 4-byte boundary.
+		padded := (attrLen + 3) &^ 3
+		body = body[4+padded:]
+	}
+
+	return nil, fmt.Errorf("xor-mapped-address not found")
+}
+
+// bindingRequest sends a single STUN Binding Request to server over a UDP socket and returns the
+// reflexive address the server observed.
+func bindingRequest(conn *net.UDPConn, server *net.UDPAddr) (*net.UDPAddr, error) {
+	id, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(requestTimeout)); err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.WriteToUDP(encodeBindingRequest(id), server); err != nil {
+		return nil, fmt.Errorf("write binding request: %w", err)
+	}
+
+	buf := make([]byte, 512)
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		return nil, fmt.Errorf("read binding response: %w", err)
+	}
+
+	return parseBindingResponse(buf[:n], id)
+}
+
+// Discover sends a Binding Request to server and returns the caller's reflexive address along
+// with a best-effort NAT classification from that single probe: full cone when the mapping equals
+// the local endpoint, port restricted cone otherwise. It never reports NATSymmetric; telling a
+// symmetric NAT apart takes a second server, see ClassifyNATType.
+func Discover(server string) (*net.UDPAddr, NATType, error) {
+	serverAddr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return nil, NATUnknown, fmt.Errorf("resolve stun server: %w", err)
+	}
+
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, NATUnknown, fmt.Errorf("listen udp: %w", err)
+	}
+	defer conn.Close()
+
+	mapped, err := bindingRequest(conn, serverAddr)
+	if err != nil {
+		return nil, NATUnknown, err
+	}
+
+	localAddr := conn.LocalAddr().(*net.UDPAddr)
+	natType := NATFullCone
+	if mapped.Port != localAddr.Port || !mapped.IP.Equal(localAddr.IP) {
+		// A second mapping against the same server, from the same local endpoint, that comes
+		// back with a different external port indicates the NAT is symmetric; ikago does not
+		// have a second rendezvous server configured here, so conservatively report port
+		// restricted cone, which DialP2P still attempts to punch through.
+		natType = NATPortRestrictedCone
+	}
+
+	return mapped, natType, nil
+}
+
+// ClassifyNATType repeats Discover against two independent STUN servers and compares the
+// reflexive mappings they report for the same local endpoint: a mapping that differs between the
+// two servers means the NAT assigns a new external endpoint per destination (symmetric).
+func ClassifyNATType(serverA, serverB string) (NATType, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return NATUnknown, fmt.Errorf("listen udp: %w", err)
+	}
+	defer conn.Close()
+
+	addrA, err := net.ResolveUDPAddr("udp4", serverA)
+	if err != nil {
+		return NATUnknown, fmt.Errorf("resolve stun server: %w", err)
+	}
+	addrB, err := net.ResolveUDPAddr("udp4", serverB)
+	if err != nil {
+		return NATUnknown, fmt.Errorf("resolve stun server: %w", err)
+	}
+
+	mappedA, err := bindingRequest(conn, addrA)
+	if err != nil {
+		return NATUnknown, err
+	}
+	mappedB, err := bindingRequest(conn, addrB)
+	if err != nil {
+		return NATUnknown, err
+	}
+
+	if mappedA.Port != mappedB.Port || !mappedA.IP.Equal(mappedB.IP) {
+		return NATSymmetric, nil
+	}
+
+	return NATFullCone, nil
+}